@@ -22,14 +22,35 @@ import (
 	"github.com/mailgun/holster"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	coordination_v1 "k8s.io/api/coordination/v1"
 	api_v1 "k8s.io/api/core/v1"
+	discovery_v1 "k8s.io/api/discovery/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
 	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// WatchMode selects which Kubernetes API K8sPool watches to discover peers.
+type WatchMode int
+
+const (
+	// WatchEndpoints watches core/v1 Endpoints (the default, and the only mode
+	// supported prior to this). Deprecated upstream in favor of EndpointSlices.
+	WatchEndpoints WatchMode = iota
+	// WatchEndpointSlices watches discovery.k8s.io/v1 EndpointSlices.
+	WatchEndpointSlices
+	// WatchPods watches core/v1 Pods directly, which allows filtering on
+	// readiness and draining peers that are terminating.
+	WatchPods
 )
 
 type K8sPool struct {
@@ -42,6 +63,11 @@ type K8sPool struct {
 	conf      K8sPoolConfig
 	informer  cache.SharedIndexInformer
 	done      chan struct{}
+	leaseHeld int32 // accessed atomically; set once our Lease is held/renewed
+
+	// leaseRenewedAt is the local time of the last successful acquire/renew of our
+	// Lease. Only touched from the runLeaseManager goroutine.
+	leaseRenewedAt time.Time
 }
 
 type K8sPoolConfig struct {
@@ -51,12 +77,50 @@ type K8sPoolConfig struct {
 	PodIP     string
 	PodPort   string
 	Enabled   bool
+
+	// WatchMode selects which API is watched for peer discovery. Defaults to
+	// WatchEndpoints.
+	WatchMode WatchMode
+	// FieldSelector is an optional field-selector applied to the watch/list calls
+	// in the WatchEndpointSlices and WatchPods modes, IE: "status.phase=Running"
+	// when WatchMode is WatchPods. It is not applied when watching Endpoints.
+	FieldSelector string
+
+	// LeaseEnabled turns on coordination.k8s.io/v1 Lease based ownership. When
+	// disabled (the default) ownership is determined by comparing PodIP against
+	// the peer address, as before.
+	LeaseEnabled bool
+	// LeaseNamespace is the namespace the Lease is created in. Defaults to Namespace.
+	LeaseNamespace string
+	// ShardID names the shard/slot this instance is contending ownership of, and
+	// names the Lease ("gubernator-<ShardID>"). It must be stable across a pod restart (e.g. a
+	// StatefulSet pod name, or a node name) -- PodIP is NOT a safe choice, since a
+	// replacement pod getting a new IP would otherwise always find "its" Lease
+	// missing and create a fresh one, defeating the purpose of the Lease. Required
+	// when LeaseEnabled is set.
+	ShardID string
+	// Identity is this instance's Lease holder identity, unique per process
+	// lifetime. Defaults to a value derived from PodIP, the process ID and the time
+	// NewK8sPool is called, so a restarted instance never mistakes a still-valid Lease held by its
+	// predecessor as already being its own.
+	Identity string
+	// LeaseDurationSeconds is how long a Lease is valid for without being renewed
+	// before another instance may take it over.
+	LeaseDurationSeconds int32
+
+	// Kubeconfig is a path to a kubeconfig file used to build the REST config when
+	// running outside the cluster (local development, CI, or a control-plane
+	// instance watching a remote cluster). Ignored if RESTConfig is set.
+	Kubeconfig string
+	// RESTConfig, if set, is used as-is instead of building one from InClusterConfig
+	// or Kubeconfig. An escape hatch for callers that already have a *rest.Config.
+	RESTConfig *rest.Config
 }
 
 func NewK8sPool(conf K8sPoolConfig) (*K8sPool, error) {
-	config, err := rest.InClusterConfig()
+	config, err := newRESTConfig(conf)
 	if err != nil {
-		return nil, errors.Wrap(err, "during InClusterConfig()")
+		return nil, err
 	}
 	// creates the client
 	client, err := kubernetes.NewForConfig(config)
@@ -64,6 +128,21 @@ func NewK8sPool(conf K8sPoolConfig) (*K8sPool, error) {
 		return nil, errors.Wrap(err, "during NewForConfig()")
 	}
 
+	if conf.LeaseEnabled {
+		if conf.ShardID == "" {
+			return nil, errors.New("K8sPoolConfig.ShardID is required when LeaseEnabled is set")
+		}
+		if conf.LeaseNamespace == "" {
+			conf.LeaseNamespace = conf.Namespace
+		}
+		if conf.Identity == "" {
+			conf.Identity = fmt.Sprintf("%s-%d-%d", conf.PodIP, os.Getpid(), time.Now().UnixNano())
+		}
+		if conf.LeaseDurationSeconds == 0 {
+			conf.LeaseDurationSeconds = 15
+		}
+	}
+
 	pool := &K8sPool{
 		log:    logrus.WithField("category", "kubernetes-pool"),
 		peers:  make(map[string]struct{}),
@@ -72,23 +151,206 @@ func NewK8sPool(conf K8sPoolConfig) (*K8sPool, error) {
 		conf:   conf,
 	}
 
+	if conf.LeaseEnabled {
+		pool.runLeaseManager()
+	}
+
 	return pool, pool.start()
 }
 
-func (e *K8sPool) start() error {
+// newRESTConfig builds the *rest.Config used to talk to the cluster. conf.RESTConfig,
+// if set, is used verbatim. Otherwise conf.Kubeconfig (or the KUBECONFIG env var, when
+// we're not running inside a pod) builds an out-of-cluster config via clientcmd, and we
+// fall back to rest.InClusterConfig() for the normal in-cluster case.
+func newRESTConfig(conf K8sPoolConfig) (*rest.Config, error) {
+	if conf.RESTConfig != nil {
+		return conf.RESTConfig, nil
+	}
 
-	e.informer = cache.NewSharedIndexInformer(
-		&cache.ListWatch{
-			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
-				options.LabelSelector = e.conf.Selector
-				return e.client.CoreV1().Endpoints(e.conf.Namespace).List(options)
+	if conf.Kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", conf.Kubeconfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "during BuildConfigFromFlags()")
+		}
+		return config, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "during BuildConfigFromFlags()")
+		}
+		return config, nil
+	}
+
+	return nil, errors.Wrap(err, "during InClusterConfig()")
+}
+
+// leaseName is the name of the Lease for this instance's shard. It is keyed off
+// ShardID (stable across restarts), not Identity (unique per process), so a
+// replacement instance for the same shard contends for the same Lease object
+// instead of always creating a new one.
+func (e *K8sPool) leaseName() string {
+	return fmt.Sprintf("gubernator-%s", e.conf.ShardID)
+}
+
+// runLeaseManager starts a background goroutine that acquires and periodically
+// renews our Lease, releasing it on Close(). Holding the Lease is checked in
+// addition to the IP comparison (see isOwner), so a freshly restarted pod that
+// inherits a prior pod's IP doesn't get marked as owner until it has actually
+// reacquired the Lease (IE: the old holder's Lease has expired). The IsOwner flag
+// of a peer is still set only for the peer whose address equals PodIP; the
+// holder identities of other instances' Leases are not read.
+func (e *K8sPool) runLeaseManager() {
+	renewInterval := time.Duration(e.conf.LeaseDurationSeconds) * time.Second / 3
+	if renewInterval <= 0 {
+		renewInterval = time.Second
+	}
+
+	e.acquireOrRenewLease()
+	tick := time.NewTicker(renewInterval)
+	e.wg.Until(func(done chan struct{}) bool {
+		select {
+		case <-tick.C:
+			e.acquireOrRenewLease()
+		case <-done:
+			tick.Stop()
+			e.releaseLease()
+			return false
+		}
+		return true
+	})
+}
+
+func (e *K8sPool) acquireOrRenewLease() {
+	// Self-expiry: if we haven't successfully renewed within our own lease
+	// duration, we must assume we are no longer the owner, regardless of whether
+	// the API calls below succeed. Without this, a partitioned instance that can't
+	// reach the API server would keep believing it holds a Lease that another,
+	// reachable instance has long since taken over -- the same self-check
+	// client-go's leaderelection does on a failed-to-renew-within-deadline.
+	if atomic.LoadInt32(&e.leaseHeld) == 1 {
+		deadline := time.Duration(e.conf.LeaseDurationSeconds) * time.Second
+		if e.leaseRenewedAt.IsZero() || time.Since(e.leaseRenewedAt) > deadline {
+			e.log.Errorf("lease '%s' not renewed within %s, assuming ownership lost", e.leaseName(), deadline)
+			atomic.StoreInt32(&e.leaseHeld, 0)
+		}
+	}
+
+	leases := e.client.CoordinationV1().Leases(e.conf.LeaseNamespace)
+	now := meta_v1.NewMicroTime(time.Now())
+
+	existing, err := leases.Get(e.leaseName(), meta_v1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		identity := e.conf.Identity
+		_, err := leases.Create(&coordination_v1.Lease{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:      e.leaseName(),
+				Namespace: e.conf.LeaseNamespace,
 			},
-			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
-				options.LabelSelector = e.conf.Selector
-				return e.client.CoreV1().Endpoints(e.conf.Namespace).Watch(options)
+			Spec: coordination_v1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &e.conf.LeaseDurationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
 			},
-		},
-		&api_v1.Endpoints{},
+		})
+		if err != nil {
+			// Another instance may have created it first (or this was a transient
+			// API error); either way we don't yet know who holds it. Leave
+			// leaseHeld as-is (subject to the self-expiry check above) and let
+			// the next tick sort it out.
+			e.log.Errorf("while creating lease '%s': %s", e.leaseName(), err)
+			return
+		}
+		atomic.StoreInt32(&e.leaseHeld, 1)
+		e.leaseRenewedAt = time.Now()
+		return
+	}
+	if err != nil {
+		// A transient error (rate limiting, a dropped connection, etc) tells us
+		// nothing about who holds the lease -- keep our previous held state
+		// rather than demoting ourselves on every hiccup. The self-expiry check
+		// above still catches a sustained outage.
+		e.log.Errorf("while fetching lease '%s': %s", e.leaseName(), err)
+		return
+	}
+
+	held := existing.Spec.HolderIdentity != nil && *existing.Spec.HolderIdentity == e.conf.Identity
+	expired := existing.Spec.RenewTime == nil || existing.Spec.LeaseDurationSeconds == nil ||
+		existing.Spec.RenewTime.Add(time.Duration(*existing.Spec.LeaseDurationSeconds)*time.Second).Before(time.Now())
+
+	if !held && !expired {
+		// Someone else holds a valid, unexpired lease -- this is the one case
+		// that genuinely means we are not (or are no longer) the owner.
+		atomic.StoreInt32(&e.leaseHeld, 0)
+		return
+	}
+
+	identity := e.conf.Identity
+	existing.Spec.HolderIdentity = &identity
+	existing.Spec.LeaseDurationSeconds = &e.conf.LeaseDurationSeconds
+	existing.Spec.RenewTime = &now
+	if !held {
+		existing.Spec.AcquireTime = &now
+	}
+
+	if _, err := leases.Update(existing); err != nil {
+		if k8s_errors.IsConflict(err) {
+			// Another instance updated the lease out from under us -- it won
+			// the race, so we are no longer (or never were) the owner.
+			e.log.Errorf("lost lease '%s' to a concurrent update", e.leaseName())
+			atomic.StoreInt32(&e.leaseHeld, 0)
+			return
+		}
+		// A transient error; keep our previous held state and retry next tick,
+		// subject to the self-expiry check above.
+		e.log.Errorf("while renewing lease '%s': %s", e.leaseName(), err)
+		return
+	}
+	atomic.StoreInt32(&e.leaseHeld, 1)
+	e.leaseRenewedAt = time.Now()
+}
+
+func (e *K8sPool) releaseLease() {
+	leases := e.client.CoordinationV1().Leases(e.conf.LeaseNamespace)
+	existing, err := leases.Get(e.leaseName(), meta_v1.GetOptions{})
+	if err != nil {
+		return
+	}
+	if existing.Spec.HolderIdentity == nil || *existing.Spec.HolderIdentity != e.conf.Identity {
+		return
+	}
+	if err := leases.Delete(e.leaseName(), &meta_v1.DeleteOptions{}); err != nil {
+		e.log.Errorf("while releasing lease '%s': %s", e.leaseName(), err)
+	}
+}
+
+// isOwner reports whether this instance should be marked as the owning peer for
+// addr. When Lease based ownership is disabled this is a simple IP comparison;
+// otherwise it also requires that we currently hold our Lease.
+func (e *K8sPool) isOwner(addr string) bool {
+	if addr != e.conf.PodIP {
+		return false
+	}
+	if !e.conf.LeaseEnabled {
+		return true
+	}
+	return atomic.LoadInt32(&e.leaseHeld) == 1
+}
+
+func (e *K8sPool) start() error {
+
+	listWatch, objType := e.newListWatch()
+
+	e.informer = cache.NewSharedIndexInformer(
+		listWatch,
+		objType,
 		0, //Skip resync
 		cache.Indexers{},
 	)
@@ -132,20 +394,75 @@ func (e *K8sPool) start() error {
 	return nil
 }
 
+// newListWatch builds the ListWatch and expected object type for the configured WatchMode.
+func (e *K8sPool) newListWatch() (*cache.ListWatch, runtime.Object) {
+	switch e.conf.WatchMode {
+	case WatchEndpointSlices:
+		return &cache.ListWatch{
+			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = e.conf.Selector
+				options.FieldSelector = e.conf.FieldSelector
+				return e.client.DiscoveryV1().EndpointSlices(e.conf.Namespace).List(options)
+			},
+			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = e.conf.Selector
+				options.FieldSelector = e.conf.FieldSelector
+				return e.client.DiscoveryV1().EndpointSlices(e.conf.Namespace).Watch(options)
+			},
+		}, &discovery_v1.EndpointSlice{}
+	case WatchPods:
+		return &cache.ListWatch{
+			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = e.conf.Selector
+				options.FieldSelector = e.conf.FieldSelector
+				return e.client.CoreV1().Pods(e.conf.Namespace).List(options)
+			},
+			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = e.conf.Selector
+				options.FieldSelector = e.conf.FieldSelector
+				return e.client.CoreV1().Pods(e.conf.Namespace).Watch(options)
+			},
+		}, &api_v1.Pod{}
+	default:
+		return &cache.ListWatch{
+			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = e.conf.Selector
+				return e.client.CoreV1().Endpoints(e.conf.Namespace).List(options)
+			},
+			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = e.conf.Selector
+				return e.client.CoreV1().Endpoints(e.conf.Namespace).Watch(options)
+			},
+		}, &api_v1.Endpoints{}
+	}
+}
+
 func (e *K8sPool) updatePeers() {
+	switch e.conf.WatchMode {
+	case WatchEndpointSlices:
+		e.updatePeersFromEndpointSlices()
+	case WatchPods:
+		e.updatePeersFromPods()
+	default:
+		e.updatePeersFromEndpoints()
+	}
+}
+
+func (e *K8sPool) updatePeersFromEndpoints() {
 	logrus.Debug("Fetching peer list from endpoints API")
 	var peers []PeerInfo
 	for _, obj := range e.informer.GetStore().List() {
 		endpoint, ok := obj.(*api_v1.Endpoints)
 		if !ok {
 			logrus.Errorf("expected type v1.Endpoints got '%s' instead", reflect.TypeOf(obj).String())
+			continue
 		}
 
 		for _, s := range endpoint.Subsets {
 			for _, addr := range s.Addresses {
 				peer := PeerInfo{Address: fmt.Sprintf("%s:%s", addr.IP, e.conf.PodPort)}
 
-				if addr.IP == e.conf.PodIP {
+				if e.isOwner(addr.IP) {
 					peer.IsOwner = true
 				}
 				peers = append(peers, peer)
@@ -156,6 +473,77 @@ func (e *K8sPool) updatePeers() {
 	e.conf.OnUpdate(peers)
 }
 
+func (e *K8sPool) updatePeersFromEndpointSlices() {
+	logrus.Debug("Fetching peer list from EndpointSlice API")
+	var peers []PeerInfo
+	for _, obj := range e.informer.GetStore().List() {
+		slice, ok := obj.(*discovery_v1.EndpointSlice)
+		if !ok {
+			logrus.Errorf("expected type discovery/v1.EndpointSlice got '%s' instead", reflect.TypeOf(obj).String())
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				peer := PeerInfo{Address: fmt.Sprintf("%s:%s", addr, e.conf.PodPort)}
+
+				if e.isOwner(addr) {
+					peer.IsOwner = true
+				}
+				peers = append(peers, peer)
+				logrus.Debugf("Peer: %+v\n", peer)
+			}
+		}
+	}
+	e.conf.OnUpdate(peers)
+}
+
+func (e *K8sPool) updatePeersFromPods() {
+	logrus.Debug("Fetching peer list from Pods API")
+	var peers []PeerInfo
+	for _, obj := range e.informer.GetStore().List() {
+		pod, ok := obj.(*api_v1.Pod)
+		if !ok {
+			logrus.Errorf("expected type v1.Pod got '%s' instead", reflect.TypeOf(obj).String())
+			continue
+		}
+
+		// Pods that are terminating are demoted out of the ring so requests
+		// drain away from them gracefully instead of stopping abruptly.
+		if pod.DeletionTimestamp != nil {
+			logrus.Debugf("Demoting peer '%s', pod is terminating", pod.Status.PodIP)
+			continue
+		}
+
+		if !isPodReady(pod) {
+			continue
+		}
+
+		peer := PeerInfo{Address: fmt.Sprintf("%s:%s", pod.Status.PodIP, e.conf.PodPort)}
+		if e.isOwner(pod.Status.PodIP) {
+			peer.IsOwner = true
+		}
+		peers = append(peers, peer)
+		logrus.Debugf("Peer: %+v\n", peer)
+	}
+	e.conf.OnUpdate(peers)
+}
+
+func isPodReady(pod *api_v1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == api_v1.PodReady {
+			return c.Status == api_v1.ConditionTrue
+		}
+	}
+	return false
+}
+
 func (e *K8sPool) Close() {
 	close(e.done)
+	if e.conf.LeaseEnabled {
+		e.wg.Stop()
+	}
 }
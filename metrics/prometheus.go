@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/stats"
+	grpc_status "google.golang.org/grpc/status"
+)
+
+// PrometheusMetrics implements the same stats.Handler interface as StatsdMetrics, but
+// records per-RPC latencies into a histogram (rather than collapsing a second's worth of
+// calls down to a single Gauge/Inc emission) and exposes everything on a `/metrics`
+// endpoint for scraping, mirroring the approach taken by go-grpc-prometheus.
+type PrometheusMetrics struct {
+	cacheStats cache.CacheStats
+	wg         holster.WaitGroup
+	server     *http.Server
+	log        *logrus.Entry
+	conf       PrometheusConfig
+
+	requestDuration *prometheus.HistogramVec
+	cacheSize       prometheus.Gauge
+	cacheHit        prometheus.Counter
+	cacheMiss       prometheus.Counter
+}
+
+type PrometheusConfig struct {
+	// Listen is the address the `/metrics` endpoint is served on, IE: `:2112`
+	Listen string
+	// Interval cache stats are polled and emitted, defaults to 1 second
+	Interval time.Duration
+}
+
+func NewPrometheusMetrics(conf PrometheusConfig) *PrometheusMetrics {
+	if conf.Interval == 0 {
+		conf.Interval = time.Second
+	}
+
+	return &PrometheusMetrics{
+		log:  logrus.WithField("category", "metrics"),
+		conf: conf,
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gubernator_grpc_request_duration_seconds",
+			Help:    "The duration of GRPC requests by method and status code",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		cacheSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gubernator_cache_size",
+			Help: "The current number of items in the cache",
+		}),
+		cacheHit: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gubernator_cache_hit",
+			Help: "The number of cache hits",
+		}),
+		cacheMiss: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gubernator_cache_miss",
+			Help: "The number of cache misses",
+		}),
+	}
+}
+
+func (m *PrometheusMetrics) Start() error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(m.requestDuration); err != nil {
+		return err
+	}
+	for _, c := range []prometheus.Collector{m.cacheSize, m.cacheHit, m.cacheMiss} {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Addr: m.conf.Listen, Handler: mux}
+
+	go func() {
+		if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			m.log.Errorf("while serving /metrics: %s", err)
+		}
+	}()
+
+	tick := time.NewTicker(m.conf.Interval)
+	m.wg.Until(func(done chan struct{}) bool {
+		select {
+		case <-tick.C:
+			if m.cacheStats != nil {
+				stats := m.cacheStats.Stats(true)
+				m.cacheSize.Set(float64(stats.Size))
+				m.cacheHit.Add(float64(stats.Hit))
+				m.cacheMiss.Add(float64(stats.Miss))
+			}
+		case <-done:
+			tick.Stop()
+			return false
+		}
+		return true
+	})
+	return nil
+}
+
+func (m *PrometheusMetrics) Stop() {
+	m.wg.Stop()
+	if m.server != nil {
+		m.server.Close()
+	}
+}
+
+func (m *PrometheusMetrics) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	rs := StatsFromContext(ctx)
+	if rs == nil {
+		return
+	}
+
+	switch t := s.(type) {
+	case *stats.End:
+		duration := t.EndTime.Sub(t.BeginTime)
+		method := rs.Method[strings.LastIndex(rs.Method, "/")+1:]
+		m.requestDuration.WithLabelValues(method, grpc_status.Code(t.Error).String()).Observe(duration.Seconds())
+	}
+}
+
+func (m *PrometheusMetrics) GRPCStatsHandler() stats.Handler                   { return m }
+func (m *PrometheusMetrics) HandleConn(ctx context.Context, s stats.ConnStats) {}
+func (m *PrometheusMetrics) RegisterCacheStats(c cache.CacheStats)             { m.cacheStats = c }
+
+func (m *PrometheusMetrics) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (m *PrometheusMetrics) TagRPC(ctx context.Context, tagInfo *stats.RPCTagInfo) context.Context {
+	return ContextWithStats(ctx, &RequestStats{Method: tagInfo.FullMethodName})
+}
+
+// Config selects which metrics backend(s) gubernator should use. Either or both of
+// Statsd and Prometheus may be enabled; when both are, RPCs are reported to each.
+type Config struct {
+	Statsd     *StatsdConfig
+	Prometheus *PrometheusConfig
+	Client     StatsdClient
+}
+
+// MultiMetrics fans out to multiple metrics backends at once, so a deployment can run
+// statsd and Prometheus side by side during a migration.
+type MultiMetrics struct {
+	backends []metricsBackend
+}
+
+type metricsBackend interface {
+	stats.Handler
+	RegisterCacheStats(cache.CacheStats)
+	Stop()
+}
+
+func New(conf Config) (*MultiMetrics, error) {
+	var m MultiMetrics
+
+	if conf.Statsd != nil {
+		client := conf.Client
+		if client == nil {
+			return nil, fmt.Errorf("metrics.Config.Client is required when Statsd is enabled")
+		}
+		sd := NewStatsdMetrics(client, *conf.Statsd)
+		if err := sd.Start(); err != nil {
+			return nil, fmt.Errorf("while starting statsd metrics: %s", err)
+		}
+		m.backends = append(m.backends, sd)
+	}
+
+	if conf.Prometheus != nil {
+		pm := NewPrometheusMetrics(*conf.Prometheus)
+		if err := pm.Start(); err != nil {
+			m.Stop()
+			return nil, fmt.Errorf("while starting prometheus metrics: %s", err)
+		}
+		m.backends = append(m.backends, pm)
+	}
+
+	return &m, nil
+}
+
+// Stop stops every backend started so far, IE: on a later backend's startup failure.
+func (m *MultiMetrics) Stop() {
+	for _, b := range m.backends {
+		b.Stop()
+	}
+}
+
+func (m *MultiMetrics) RegisterCacheStats(c cache.CacheStats) {
+	for _, b := range m.backends {
+		b.RegisterCacheStats(c)
+	}
+}
+
+func (m *MultiMetrics) GRPCStatsHandler() stats.Handler { return m }
+
+func (m *MultiMetrics) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	for _, b := range m.backends {
+		b.HandleRPC(ctx, s)
+	}
+}
+
+func (m *MultiMetrics) HandleConn(ctx context.Context, s stats.ConnStats) {
+	for _, b := range m.backends {
+		b.HandleConn(ctx, s)
+	}
+}
+
+func (m *MultiMetrics) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	for _, b := range m.backends {
+		ctx = b.TagConn(ctx, info)
+	}
+	return ctx
+}
+
+func (m *MultiMetrics) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	for _, b := range m.backends {
+		ctx = b.TagRPC(ctx, info)
+	}
+	return ctx
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mailgun/gubernator/cache"
@@ -13,6 +14,14 @@ import (
 	"google.golang.org/grpc/stats"
 )
 
+const (
+	// DefaultReqChanSize is the default size of the buffered channel HandleRPC sends
+	// completed RequestStats on.
+	DefaultReqChanSize = 10000
+	// DefaultTickInterval is the default interval stats are aggregated and emitted on.
+	DefaultTickInterval = time.Second
+)
+
 type StatsdClient interface {
 	Gauge(string, int64)
 	Inc(string, int64)
@@ -31,21 +40,31 @@ type StatsdMetrics struct {
 	wg         holster.WaitGroup
 	client     StatsdClient
 	log        *logrus.Entry
+	conf       StatsdConfig
+	dropped    int64 // accessed atomically; count of RequestStats dropped by HandleRPC
 }
 
-func NewStatsdMetrics(client StatsdClient) *StatsdMetrics {
+func NewStatsdMetrics(client StatsdClient, conf StatsdConfig) *StatsdMetrics {
+	if conf.ChanSize == 0 {
+		conf.ChanSize = DefaultReqChanSize
+	}
+	if conf.Interval == 0 {
+		conf.Interval = DefaultTickInterval
+	}
+
 	sd := StatsdMetrics{
 		client: client,
+		conf:   conf,
 		log:    logrus.WithField("category", "metrics"),
 	}
 	return &sd
 }
 
 func (sd *StatsdMetrics) Start() error {
-	sd.reqChan = make(chan *RequestStats, 10000)
+	sd.reqChan = make(chan *RequestStats, sd.conf.ChanSize)
 	methods := make(map[string]RequestStats)
 
-	tick := time.NewTicker(time.Second)
+	tick := time.NewTicker(sd.conf.Interval)
 	sd.wg.Until(func(done chan struct{}) bool {
 		select {
 		case stat := <-sd.reqChan:
@@ -72,10 +91,15 @@ func (sd *StatsdMetrics) Start() error {
 			// Clear the current method stats
 			methods = make(map[string]RequestStats, len(methods))
 
+			// Emit the count of RequestStats dropped because reqChan was full
+			if dropped := atomic.SwapInt64(&sd.dropped, 0); dropped != 0 {
+				sd.client.Inc("metrics.dropped", dropped)
+			}
+
 			// Emit stats about our cache
 			if sd.cacheStats != nil {
 				stats := sd.cacheStats.Stats(true)
-				sd.client.Inc("cache.size", stats.Size)
+				sd.client.Gauge("cache.size", stats.Size)
 				sd.client.Inc("cache.hit", stats.Hit)
 				sd.client.Inc("cache.miss", stats.Miss)
 			}
@@ -112,7 +136,12 @@ func (sd *StatsdMetrics) HandleRPC(ctx context.Context, s stats.RPCStats) {
 		if t.Error != nil {
 			rs.Failed = 1
 		}
-		sd.reqChan <- rs
+		select {
+		case sd.reqChan <- rs:
+		default:
+			// reqChan is full; drop rather than block the RPC.
+			atomic.AddInt64(&sd.dropped, 1)
+		}
 	}
 }
 
@@ -149,4 +178,7 @@ type StatsdConfig struct {
 	Interval time.Duration
 	Endpoint string
 	Prefix   string
+	// ChanSize is the size of the buffered channel HandleRPC sends completed
+	// RequestStats on. Defaults to DefaultReqChanSize.
+	ChanSize int
 }